@@ -4,8 +4,14 @@
 package semtech
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/TheThingsNetwork/ttn/core"
 	"github.com/TheThingsNetwork/ttn/semtech"
@@ -14,8 +20,35 @@ import (
 
 type Adapter struct {
 	log.Logger
-	conn chan udpMsg
-	next chan rxpkMsg
+	conn      chan udpMsg
+	next      chan rxpkMsg
+	pullAddrs pullAddrCache
+	pending   pendingAcks
+
+	proxyProtocol bool // Parse a PROXY protocol v2 header ahead of every datagram
+	proxyStrict   bool // Drop datagrams that don't carry a valid PROXY v2 header
+}
+
+// Option configures an Adapter created through NewAdapter.
+type Option func(*Adapter)
+
+// WithLoggers attaches the given loggers to the adapter.
+func WithLoggers(loggers ...log.Logger) Option {
+	return func(a *Adapter) {
+		a.Logger = log.MultiLogger{Loggers: loggers}
+	}
+}
+
+// WithProxyProtocol enables PROXY protocol v2 (UDP variant, as defined by
+// HAProxy) parsing on incoming datagrams, so the real gateway address
+// survives behind a NAT or a UDP load-balancer. When strict is true,
+// datagrams that don't start with a valid v2 header are dropped instead of
+// being treated as raw Semtech traffic.
+func WithProxyProtocol(strict bool) Option {
+	return func(a *Adapter) {
+		a.proxyProtocol = true
+		a.proxyStrict = strict
+	}
 }
 
 type udpMsg struct {
@@ -29,18 +62,211 @@ type rxpkMsg struct {
 	recipient core.Recipient
 }
 
+// pullAddressTTL bounds how long a gateway's last known PULL_DATA source is
+// considered valid for scheduling a downlink. Gateways re-issue PULL_DATA
+// every few seconds to keep their NAT mapping alive, so anything older than
+// this is almost certainly stale.
+const pullAddressTTL = 90 * time.Second
+
+// txAckTimeout is how long Send() waits for a TX_ACK before giving up on a
+// gateway that silently drops the PULL_RESP.
+const txAckTimeout = 3 * time.Second
+
+// pullAddrCache remembers, per GatewayId, the UDP address a gateway last
+// contacted us from via PULL_DATA. That's where PULL_RESP downlinks have to
+// be sent, since gateways are usually behind a NAT and don't listen on any
+// well-known address of their own.
+type pullAddrCache struct {
+	sync.Mutex
+	entries map[string]pullAddrEntry
+}
+
+type pullAddrEntry struct {
+	addr *net.UDPAddr
+	seen time.Time
+}
+
+func (c *pullAddrCache) set(gatewayId string, addr *net.UDPAddr) {
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]pullAddrEntry)
+	}
+	c.entries[gatewayId] = pullAddrEntry{addr: addr, seen: time.Now()}
+}
+
+func (c *pullAddrCache) get(gatewayId string) *net.UDPAddr {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[gatewayId]
+	if !ok || time.Since(entry.seen) > pullAddressTTL {
+		delete(c.entries, gatewayId)
+		return nil
+	}
+	return entry.addr
+}
+
+// pendingAcks correlates outgoing PULL_RESP packets with the TX_ACK that
+// eventually comes back for them, keyed by the GatewayId and token carried
+// on the wire. The token alone isn't enough: it's only 2 bytes, so with
+// more than a couple hundred in-flight downlinks across every gateway an
+// adapter instance serves, two Send() calls can land the same token, and
+// keying on the token alone would let gateway A's TX_ACK resolve gateway
+// B's pending Send().
+type pendingAcks struct {
+	sync.Mutex
+	acks map[pendingAckKey]chan error
+}
+
+type pendingAckKey struct {
+	gatewayId string
+	token     [2]byte
+}
+
+func (p *pendingAcks) register(gatewayId string, token [2]byte) chan error {
+	p.Lock()
+	defer p.Unlock()
+	if p.acks == nil {
+		p.acks = make(map[pendingAckKey]chan error)
+	}
+	ack := make(chan error, 1)
+	p.acks[pendingAckKey{gatewayId, token}] = ack
+	return ack
+}
+
+func (p *pendingAcks) resolve(gatewayId string, token [2]byte, err error) {
+	key := pendingAckKey{gatewayId, token}
+	p.Lock()
+	ack, ok := p.acks[key]
+	if ok {
+		delete(p.acks, key)
+	}
+	p.Unlock()
+	if ok {
+		ack <- err
+	}
+}
+
+func (p *pendingAcks) forget(gatewayId string, token [2]byte) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.acks, pendingAckKey{gatewayId, token})
+}
+
+func newToken() [2]byte {
+	var token [2]byte
+	rand.Read(token[:])
+	return token
+}
+
+// proxyV2Signature is the fixed 12-byte signature every PROXY protocol v2
+// header starts with, as defined by the HAProxy spec.
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// parseProxyV2 parses a PROXY protocol v2 header (UDP variant) from the
+// head of buf. It returns the client address carried by the header (nil for
+// a LOCAL command, which carries none), the number of header bytes to
+// strip off buf to get to the Semtech payload, and ok=false when buf
+// doesn't start with a valid v2 header.
+func parseProxyV2(buf []byte) (client *net.UDPAddr, consumed int, ok bool) {
+	const sigLen = 12
+	if len(buf) < sigLen+4 || !bytes.Equal(buf[:sigLen], proxyV2Signature) {
+		return nil, 0, false
+	}
+
+	verCmd, famProto := buf[sigLen], buf[sigLen+1]
+	if verCmd>>4 != 2 { // only version 2 is supported
+		return nil, 0, false
+	}
+	length := int(binary.BigEndian.Uint16(buf[sigLen+2 : sigLen+4]))
+	header := sigLen + 4
+	if len(buf) < header+length {
+		return nil, 0, false
+	}
+	consumed = header + length
+
+	if verCmd&0x0F == 0 { // LOCAL command: no address, e.g. a health check
+		return nil, consumed, true
+	}
+
+	addrBlock := buf[header : header+length]
+	switch famProto >> 4 {
+	case 0x1: // AF_INET
+		if len(addrBlock) < 12 {
+			return nil, 0, false
+		}
+		ip := net.IPv4(addrBlock[0], addrBlock[1], addrBlock[2], addrBlock[3])
+		port := binary.BigEndian.Uint16(addrBlock[8:10])
+		return &net.UDPAddr{IP: ip, Port: int(port)}, consumed, true
+	case 0x2: // AF_INET6
+		if len(addrBlock) < 36 {
+			return nil, 0, false
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, addrBlock[:16])
+		port := binary.BigEndian.Uint16(addrBlock[32:34])
+		return &net.UDPAddr{IP: ip, Port: int(port)}, consumed, true
+	default:
+		return nil, 0, false
+	}
+}
+
 var ErrInvalidPort error = fmt.Errorf("Invalid port supplied. The connection might be already taken")
 var ErrNotInitialized error = fmt.Errorf("Illegal call on non-initialized adapter")
 var ErrNotSupported error = fmt.Errorf("Unsupported operation")
 var ErrInvalidPacket error = fmt.Errorf("Invalid packet supplied")
+var ErrGatewayNotConnected error = fmt.Errorf("Gateway has no known pull address to send a downlink to")
+var ErrTxAckTimeout error = fmt.Errorf("Gateway did not acknowledge the downlink in time")
+var ErrTxTooLate error = fmt.Errorf("Gateway rejected downlink: too late")
+var ErrTxTooEarly error = fmt.Errorf("Gateway rejected downlink: too early")
+var ErrTxCollisionPacket error = fmt.Errorf("Gateway rejected downlink: collision with another packet")
+var ErrTxCollisionBeacon error = fmt.Errorf("Gateway rejected downlink: collision with a beacon")
+var ErrTxFreq error = fmt.Errorf("Gateway rejected downlink: frequency not supported")
+var ErrTxPower error = fmt.Errorf("Gateway rejected downlink: power not supported")
 
-// New constructs and allocates a new udp_sender adapter
+// txAckError turns the textual error code carried by a TX_ACK into one of
+// the sentinel errors above so Send() can surface something callers can
+// compare against.
+func txAckError(code string) error {
+	switch code {
+	case "", "NONE":
+		return nil
+	case "TOO_LATE":
+		return ErrTxTooLate
+	case "TOO_EARLY":
+		return ErrTxTooEarly
+	case "COLLISION_PACKET":
+		return ErrTxCollisionPacket
+	case "COLLISION_BEACON":
+		return ErrTxCollisionBeacon
+	case "TX_FREQ":
+		return ErrTxFreq
+	case "TX_POWER":
+		return ErrTxPower
+	default:
+		return fmt.Errorf("Gateway rejected downlink: %s", code)
+	}
+}
+
+// NewAdapter constructs and allocates a new udp_sender adapter, attaching
+// loggers the same way it always has. Existing callers of this signature
+// don't need to change; reach for NewAdapterWithOptions to also enable
+// PROXY protocol v2 or any other Option.
 func NewAdapter(port uint, loggers ...log.Logger) (*Adapter, error) {
+	return NewAdapterWithOptions(port, WithLoggers(loggers...))
+}
+
+// NewAdapterWithOptions constructs and allocates a new udp_sender adapter
+// configured through opts (see WithLoggers, WithProxyProtocol).
+func NewAdapterWithOptions(port uint, opts ...Option) (*Adapter, error) {
 	a := Adapter{
-		Logger: log.MultiLogger{Loggers: loggers},
+		Logger: log.MultiLogger{},
 		conn:   make(chan udpMsg),
 		next:   make(chan rxpkMsg),
 	}
+	for _, opt := range opts {
+		opt(&a)
+	}
 
 	// Create the udp connection and start listening with a goroutine
 	var udpConn *net.UDPConn
@@ -62,9 +288,90 @@ func (a *Adapter) ok() bool {
 	return a != nil && a.conn != nil && a.next != nil
 }
 
-// Send implements the core.Adapter interface
+// Send implements the core.Adapter interface. It schedules p as a PULL_RESP
+// downlink towards the gateway behind recipient, and waits for the
+// corresponding TX_ACK to come back.
 func (a *Adapter) Send(p core.Packet, r ...core.Recipient) (core.Packet, error) {
-	return core.Packet{}, ErrNotSupported
+	if !a.ok() {
+		return core.Packet{}, ErrNotInitialized
+	}
+	if len(r) != 1 {
+		return core.Packet{}, ErrInvalidPacket
+	}
+	recipient := r[0]
+
+	addr := a.pullAddrs.get(recipient.Id)
+	if addr == nil {
+		return core.Packet{}, ErrGatewayNotConnected
+	}
+
+	txpk, err := buildTXPK(p)
+	if err != nil {
+		a.Logf("Unable to convert packet to TXPK: %v", err)
+		return core.Packet{}, ErrInvalidPacket
+	}
+
+	token := newToken()
+	raw, err := semtech.Marshal(semtech.Packet{
+		Version:    semtech.VERSION,
+		Token:      token,
+		Identifier: semtech.PULL_RESP,
+		Payload:    &semtech.Payload{TXPK: &txpk},
+	})
+	if err != nil {
+		a.Logf("Unexpected error while marshaling PULL_RESP: %v", err)
+		return core.Packet{}, ErrInvalidPacket
+	}
+
+	ack := a.pending.register(recipient.Id, token)
+	defer a.pending.forget(recipient.Id, token)
+
+	a.Logf("Sending PULL_RESP to %v", addr)
+	a.conn <- udpMsg{addr: addr, raw: raw}
+
+	select {
+	case err := <-ack:
+		return core.Packet{}, err
+	case <-time.After(txAckTimeout):
+		return core.Packet{}, ErrTxAckTimeout
+	}
+}
+
+// buildTXPK converts a core.Packet scheduled for downlink into the TXPK
+// representation expected by the Semtech packet-forwarder protocol.
+func buildTXPK(p core.Packet) (semtech.TXPK, error) {
+	payload, err := p.MarshalBinary()
+	if err != nil {
+		return semtech.TXPK{}, err
+	}
+	data := base64.StdEncoding.EncodeToString(payload)
+	size := uint(len(payload))
+
+	metadata := p.Metadata()
+	txpk := semtech.TXPK{
+		Freq: metadata.Frequency,
+		Rfch: metadata.RFChain,
+		Powe: metadata.Power,
+		Modu: metadata.Modulation,
+		Datr: metadata.DataRate,
+		Codr: metadata.CodingRate,
+		Ipol: true,
+		Size: size,
+		Data: data,
+	}
+
+	if metadata.Timestamp == 0 {
+		txpk.Imme = true
+	} else {
+		txpk.Tmst = metadata.Timestamp
+	}
+
+	return txpk, nil
+}
+
+// NextRegistration implements the core.Adapter interface
+func (a *Adapter) NextRegistration() (core.Packet, core.AckNacker, error) {
+	return core.Packet{}, nil, ErrNotSupported
 }
 
 // Next implements the core.Adapter interface
@@ -81,25 +388,42 @@ func (a *Adapter) Next() (core.Packet, core.AckNacker, error) {
 	return packet, semtechAckNacker{recipient: msg.recipient, conn: a.conn}, nil
 }
 
-// NextRegistration implements the core.Adapter interface
-func (a *Adapter) NextRegistration() (core.Packet, core.AckNacker, error) {
-	return core.Packet{}, nil, ErrNotSupported
-}
-
 // listen Handle incoming packets and forward them
 func (a *Adapter) listen(conn *net.UDPConn) {
 	defer conn.Close()
 	a.Logf("Start listening on %s", conn.LocalAddr())
 	for {
-		buf := make([]byte, 128)
+		buf := make([]byte, 512)
 		n, addr, err := conn.ReadFromUDP(buf)
 		if err != nil { // Problem with the connection
 			a.Logf("Error: %v", err)
 			continue
 		}
-		a.Logf("Incoming datagram %x", buf[:n])
+		payload := buf[:n]
+
+		// addr is where replies must be sent: the last hop before us,
+		// i.e. the load-balancer when PROXY protocol is in play. client
+		// is who the gateway actually is, taken from the PROXY header
+		// when present, and defaults to addr otherwise.
+		client := addr
+		if a.proxyProtocol {
+			proxied, consumed, ok := parseProxyV2(payload)
+			if !ok {
+				if a.proxyStrict {
+					a.Logf("Dropping datagram without a valid PROXY protocol v2 header from %v", addr)
+					continue
+				}
+			} else {
+				payload = payload[consumed:]
+				if proxied != nil {
+					client = proxied
+				}
+			}
+		}
+
+		a.Logf("Incoming datagram %x", payload)
 
-		pkt, err := semtech.Unmarshal(buf[:n])
+		pkt, err := semtech.Unmarshal(payload)
 		if err != nil {
 			a.Logf("Error: %v", err)
 			continue
@@ -107,6 +431,8 @@ func (a *Adapter) listen(conn *net.UDPConn) {
 
 		switch pkt.Identifier {
 		case semtech.PULL_DATA: // PULL_DATA -> Respond to the recipient with an ACK
+			a.pullAddrs.set(pkt.GatewayId, addr)
+
 			pullAck, err := semtech.Marshal(semtech.Packet{
 				Version:    semtech.VERSION,
 				Token:      pkt.Token,
@@ -138,9 +464,15 @@ func (a *Adapter) listen(conn *net.UDPConn) {
 			for _, rxpk := range pkt.Payload.RXPK {
 				a.next <- rxpkMsg{
 					rxpk:      rxpk,
-					recipient: core.Recipient{Address: addr, Id: pkt.GatewayId},
+					recipient: core.Recipient{Address: client, Id: pkt.GatewayId},
 				}
 			}
+		case semtech.TX_ACK: // TX_ACK -> Correlate with the pending Send() by GatewayId and token
+			var ackErr error
+			if pkt.Payload != nil && pkt.Payload.TXPKACK != nil {
+				ackErr = txAckError(pkt.Payload.TXPKACK.Error)
+			}
+			a.pending.resolve(pkt.GatewayId, pkt.Token, ackErr)
 		default:
 			a.Logf("Unexpected packet received. Ignored: %v", pkt)
 			continue
@@ -169,4 +501,4 @@ func (a *Adapter) monitorConnection() {
 	if udpConn != nil {
 		udpConn.Close() // Make sure we close the connection before leaving if we dare ever leave.
 	}
-}
\ No newline at end of file
+}
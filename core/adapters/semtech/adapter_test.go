@@ -0,0 +1,184 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package semtech
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/semtech"
+)
+
+// dialGateway opens a loopback UDP socket that plays the role of a Semtech
+// packet-forwarder talking to the adapter on port.
+func dialGateway(t *testing.T, port uint) *net.UDPConn {
+	raddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("Unable to resolve adapter address: %v", err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("Unable to dial adapter: %v", err)
+	}
+	return conn
+}
+
+func TestFullGatewayCycle(t *testing.T) {
+	adapter, err := NewAdapter(34001)
+	if err != nil {
+		t.Fatalf("Unable to start adapter: %v", err)
+	}
+
+	gw := dialGateway(t, 34001)
+	defer gw.Close()
+	gw.SetReadDeadline(time.Now().Add(time.Second))
+
+	gatewayId := string([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+
+	// 1. PULL_DATA -> PULL_ACK, and the adapter should remember our address.
+	pullToken := [2]byte{0x12, 0x34}
+	pullData, _ := semtech.Marshal(semtech.Packet{
+		Version:    semtech.VERSION,
+		Token:      pullToken,
+		Identifier: semtech.PULL_DATA,
+		GatewayId:  gatewayId,
+	})
+	if _, err := gw.Write(pullData); err != nil {
+		t.Fatalf("Unable to send PULL_DATA: %v", err)
+	}
+
+	buf := make([]byte, 128)
+	n, err := gw.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected a PULL_ACK, got error: %v", err)
+	}
+	pullAck, err := semtech.Unmarshal(buf[:n])
+	if err != nil || pullAck.Identifier != semtech.PULL_ACK {
+		t.Fatalf("Expected a well-formed PULL_ACK, got %v (err: %v)", pullAck, err)
+	}
+
+	// 2. PUSH_DATA -> PUSH_ACK, and the RXPK should come out of Next().
+	pushToken := [2]byte{0x56, 0x78}
+	pushData, _ := semtech.Marshal(semtech.Packet{
+		Version:    semtech.VERSION,
+		Token:      pushToken,
+		Identifier: semtech.PUSH_DATA,
+		GatewayId:  gatewayId,
+		Payload: &semtech.Payload{
+			RXPK: []semtech.RXPK{{}},
+		},
+	})
+	if _, err := gw.Write(pushData); err != nil {
+		t.Fatalf("Unable to send PUSH_DATA: %v", err)
+	}
+
+	n, err = gw.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected a PUSH_ACK, got error: %v", err)
+	}
+	pushAck, err := semtech.Unmarshal(buf[:n])
+	if err != nil || pushAck.Identifier != semtech.PUSH_ACK {
+		t.Fatalf("Expected a well-formed PUSH_ACK, got %v (err: %v)", pushAck, err)
+	}
+
+	packet, ackNacker, err := adapter.Next()
+	if err != nil {
+		t.Fatalf("Unexpected error from Next(): %v", err)
+	}
+	_ = packet
+	_ = ackNacker
+
+	// 3. Send() should emit a PULL_RESP towards the gateway's known address,
+	// and complete once we reply with a matching TX_ACK.
+	done := make(chan error, 1)
+	go func() {
+		_, err := adapter.Send(core.Packet{}, core.Recipient{Id: gatewayId})
+		done <- err
+	}()
+
+	n, err = gw.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected a PULL_RESP, got error: %v", err)
+	}
+	pullResp, err := semtech.Unmarshal(buf[:n])
+	if err != nil || pullResp.Identifier != semtech.PULL_RESP {
+		t.Fatalf("Expected a well-formed PULL_RESP, got %v (err: %v)", pullResp, err)
+	}
+
+	txAck, _ := semtech.Marshal(semtech.Packet{
+		Version:    semtech.VERSION,
+		Token:      pullResp.Token,
+		Identifier: semtech.TX_ACK,
+		GatewayId:  gatewayId,
+		Payload: &semtech.Payload{
+			TXPKACK: &semtech.TXPKAck{Error: "NONE"},
+		},
+	})
+	if _, err := gw.Write(txAck); err != nil {
+		t.Fatalf("Unable to send TX_ACK: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected Send() to succeed, got: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Send() did not return in time")
+	}
+}
+
+// TestPendingAcksScopedByGateway guards against token collisions across
+// gateways: two Send() calls to different gateways can easily draw the
+// same 2-byte token, and a TX_ACK for one must never resolve the other's
+// pending ack.
+func TestPendingAcksScopedByGateway(t *testing.T) {
+	var pending pendingAcks
+	token := [2]byte{0xAB, 0xCD}
+
+	ackA := pending.register("gatewayA", token)
+	ackB := pending.register("gatewayB", token)
+
+	pending.resolve("gatewayA", token, ErrTxFreq)
+
+	select {
+	case err := <-ackA:
+		if err != ErrTxFreq {
+			t.Fatalf("Expected gatewayA's ack to resolve with ErrTxFreq, got %v", err)
+		}
+	default:
+		t.Fatalf("Expected gatewayA's ack to be resolved")
+	}
+
+	select {
+	case err := <-ackB:
+		t.Fatalf("Expected gatewayB's ack to remain pending, got %v", err)
+	default:
+	}
+
+	pending.resolve("gatewayB", token, nil)
+	select {
+	case err := <-ackB:
+		if err != nil {
+			t.Fatalf("Expected gatewayB's ack to resolve with nil, got %v", err)
+		}
+	default:
+		t.Fatalf("Expected gatewayB's ack to be resolved")
+	}
+}
+
+func TestSendUnknownGateway(t *testing.T) {
+	adapter, err := NewAdapter(34002)
+	if err != nil {
+		t.Fatalf("Unable to start adapter: %v", err)
+	}
+
+	_, err = adapter.Send(core.Packet{}, core.Recipient{Id: "unknown-gateway"})
+	if err != ErrGatewayNotConnected {
+		t.Fatalf("Expected ErrGatewayNotConnected, got: %v", err)
+	}
+}
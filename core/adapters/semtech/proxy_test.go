@@ -0,0 +1,165 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package semtech
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/semtech"
+)
+
+// proxyV2Header builds a minimal PROXY protocol v2 UDP header (command
+// PROXY, family AF_INET, protocol DGRAM) fronting srcIP:srcPort.
+func proxyV2Header(t *testing.T, srcIP net.IP, srcPort int) []byte {
+	header := make([]byte, 16+12)
+	copy(header, proxyV2Signature)
+	header[12] = 0x21 // version 2, command PROXY
+	header[13] = 0x12 // family AF_INET, protocol DGRAM
+	binary.BigEndian.PutUint16(header[14:16], 12)
+
+	ip4 := srcIP.To4()
+	if ip4 == nil {
+		t.Fatalf("expected an IPv4 address, got %v", srcIP)
+	}
+	copy(header[16:20], ip4)
+	copy(header[20:24], net.IPv4(127, 0, 0, 1).To4())
+	binary.BigEndian.PutUint16(header[24:26], uint16(srcPort))
+	binary.BigEndian.PutUint16(header[26:28], 1700)
+	return header
+}
+
+func TestListenWithProxyProtocol(t *testing.T) {
+	adapter, err := NewAdapterWithOptions(34010, WithProxyProtocol(false))
+	if err != nil {
+		t.Fatalf("Unable to start adapter: %v", err)
+	}
+
+	gw := dialGateway(t, 34010)
+	defer gw.Close()
+
+	gatewayId := string([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	pushData, _ := semtech.Marshal(semtech.Packet{
+		Version:    semtech.VERSION,
+		Token:      [2]byte{0x11, 0x22},
+		Identifier: semtech.PUSH_DATA,
+		GatewayId:  gatewayId,
+		Payload: &semtech.Payload{
+			RXPK: []semtech.RXPK{{}},
+		},
+	})
+
+	originalIP := net.IPv4(203, 0, 113, 42)
+	datagram := append(proxyV2Header(t, originalIP, 9001), pushData...)
+	if _, err := gw.Write(datagram); err != nil {
+		t.Fatalf("Unable to send PROXY-framed PUSH_DATA: %v", err)
+	}
+
+	gw.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 128)
+	if _, err := gw.Read(buf); err != nil {
+		t.Fatalf("Expected a PUSH_ACK, got error: %v", err)
+	}
+
+	_, ackNacker, err := adapter.Next()
+	if err != nil {
+		t.Fatalf("Unexpected error from Next(): %v", err)
+	}
+	recipient := ackNacker.(semtechAckNacker).recipient
+	if recipient.Address.String() != "203.0.113.42:9001" {
+		t.Fatalf("Expected the recipient address surfaced by Next() to be the proxied client, got %v", recipient.Address)
+	}
+}
+
+func TestListenWithProxyProtocolRawFallback(t *testing.T) {
+	adapter, err := NewAdapterWithOptions(34011, WithProxyProtocol(false))
+	if err != nil {
+		t.Fatalf("Unable to start adapter: %v", err)
+	}
+
+	gw := dialGateway(t, 34011)
+	defer gw.Close()
+
+	gatewayId := string([]byte{8, 7, 6, 5, 4, 3, 2, 1})
+	pushData, _ := semtech.Marshal(semtech.Packet{
+		Version:    semtech.VERSION,
+		Token:      [2]byte{0x33, 0x44},
+		Identifier: semtech.PUSH_DATA,
+		GatewayId:  gatewayId,
+		Payload: &semtech.Payload{
+			RXPK: []semtech.RXPK{{}},
+		},
+	})
+
+	// A raw (non-PROXY) datagram must still be accepted in non-strict mode.
+	if _, err := gw.Write(pushData); err != nil {
+		t.Fatalf("Unable to send raw PUSH_DATA: %v", err)
+	}
+
+	gw.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 128)
+	if _, err := gw.Read(buf); err != nil {
+		t.Fatalf("Expected a PUSH_ACK, got error: %v", err)
+	}
+
+	_, ackNacker, err := adapter.Next()
+	if err != nil {
+		t.Fatalf("Unexpected error from Next(): %v", err)
+	}
+	recipient := ackNacker.(semtechAckNacker).recipient
+	if recipient.Address.String() != gw.LocalAddr().String() {
+		t.Fatalf("Expected the recipient address surfaced by Next() to be the raw datagram's source %v, got %v", gw.LocalAddr(), recipient.Address)
+	}
+}
+
+func TestListenWithProxyProtocolStrictDropsRaw(t *testing.T) {
+	adapter, err := NewAdapterWithOptions(34012, WithProxyProtocol(true))
+	if err != nil {
+		t.Fatalf("Unable to start adapter: %v", err)
+	}
+
+	gw := dialGateway(t, 34012)
+	defer gw.Close()
+
+	pushData, _ := semtech.Marshal(semtech.Packet{
+		Version:    semtech.VERSION,
+		Token:      [2]byte{0x55, 0x66},
+		Identifier: semtech.PUSH_DATA,
+		GatewayId:  string([]byte{1, 1, 1, 1, 1, 1, 1, 1}),
+		Payload: &semtech.Payload{
+			RXPK: []semtech.RXPK{{}},
+		},
+	})
+	if _, err := gw.Write(pushData); err != nil {
+		t.Fatalf("Unable to send raw PUSH_DATA: %v", err)
+	}
+
+	gw.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 128)
+	if _, err := gw.Read(buf); err == nil {
+		t.Fatalf("Expected the strict adapter to drop the raw datagram, got a reply")
+	}
+}
+
+func TestParseProxyV2(t *testing.T) {
+	ip := net.IPv4(198, 51, 100, 7)
+	header := proxyV2Header(t, ip, 4242)
+
+	client, consumed, ok := parseProxyV2(header)
+	if !ok {
+		t.Fatalf("Expected a valid PROXY v2 header to parse")
+	}
+	if consumed != len(header) {
+		t.Fatalf("Expected to consume %d bytes, got %d", len(header), consumed)
+	}
+	if !client.IP.Equal(ip) || client.Port != 4242 {
+		t.Fatalf("Unexpected client address: %v", client)
+	}
+
+	if _, _, ok := parseProxyV2([]byte{0x00, 0x01, 0x02}); ok {
+		t.Fatalf("Expected a short, non-PROXY buffer to fail to parse")
+	}
+}
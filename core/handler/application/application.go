@@ -0,0 +1,45 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+// Package application stores the handler-side configuration of registered
+// applications: their payload functions and a store-maintained version.
+package application
+
+import (
+	"context"
+	"fmt"
+)
+
+// Application represents a handler-side application registration.
+type Application struct {
+	AppID     string
+	Decoder   string
+	Converter string
+	Validator string
+	Encoder   string
+
+	// ResourceVersion is bumped by the store on every successful Set, and
+	// used by CompareAndSet to detect concurrent modifications.
+	ResourceVersion uint64
+}
+
+// ErrConflict is returned by CompareAndSet when the stored ResourceVersion
+// no longer matches expectedVersion, i.e. someone else updated the
+// Application in the meantime.
+var ErrConflict = fmt.Errorf("application: resource was modified concurrently")
+
+// Store is used to store and retrieve application configurations.
+type Store interface {
+	// List all Applications.
+	List(ctx context.Context) ([]*Application, error)
+	// Get a specific Application.
+	Get(ctx context.Context, appID string) (*Application, error)
+	// Set a specific Application, optionally only updating the given fields.
+	Set(ctx context.Context, app *Application, fields ...string) error
+	// CompareAndSet updates app like Set, but only if its ResourceVersion in
+	// the store still equals expectedVersion. It returns ErrConflict
+	// otherwise, so callers can re-read and retry their tryUpdate closure.
+	CompareAndSet(ctx context.Context, app *Application, expectedVersion uint64, fields ...string) error
+	// Delete a specific Application.
+	Delete(ctx context.Context, appID string) error
+}
@@ -0,0 +1,188 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package application
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+// redisApplicationStore is a Store that persists Applications as a Redis
+// hash per appID, one field per attribute.
+type redisApplicationStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedisApplicationStore creates a new Store that uses client for
+// storage. client is a redis.UniversalClient so the handler can be pointed
+// at a single node, a Sentinel-monitored master or a Redis Cluster without
+// any code changes.
+func NewRedisApplicationStore(client redis.UniversalClient, prefix string) Store {
+	return &redisApplicationStore{client: client, prefix: prefix}
+}
+
+// NewRedisApplicationStoreFromConfig builds the redis.UniversalClient from
+// opts before handing it to NewRedisApplicationStore. opts decides, based on
+// its fields, whether the handler talks to a single node, a Sentinel setup
+// or a Cluster.
+func NewRedisApplicationStoreFromConfig(opts *redis.UniversalOptions, prefix string) Store {
+	return NewRedisApplicationStore(redis.NewUniversalClient(opts), prefix)
+}
+
+func (s *redisApplicationStore) key(appID string) string {
+	return fmt.Sprintf("%s:application:%s", s.prefix, appID)
+}
+
+func (s *redisApplicationStore) List(ctx context.Context) ([]*Application, error) {
+	pattern := s.key("*")
+	keys, err := s.client.Keys(ctx, pattern).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	apps := make([]*Application, 0, len(keys))
+	for _, key := range keys {
+		app, err := s.getByKey(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if app != nil {
+			apps = append(apps, app)
+		}
+	}
+	return apps, nil
+}
+
+func (s *redisApplicationStore) Get(ctx context.Context, appID string) (*Application, error) {
+	return s.getByKey(ctx, s.key(appID))
+}
+
+func (s *redisApplicationStore) getByKey(ctx context.Context, key string) (*Application, error) {
+	raw, err := s.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	return decodeApplication(raw)
+}
+
+// Set writes app to the store, bumping its ResourceVersion. The increment
+// and the field write are wrapped in the same WATCH/MULTI/EXEC transaction
+// as CompareAndSet, so two concurrent Set calls can never land a
+// resource_version paired with the other writer's fields; unlike
+// CompareAndSet, Set has no caller-supplied expected version to conflict
+// on, so it transparently retries if a racing writer touches the key
+// between WATCH and EXEC.
+func (s *redisApplicationStore) Set(ctx context.Context, app *Application, fields ...string) error {
+	for {
+		err := s.transactionalWrite(ctx, app, fields, nil)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return err
+	}
+}
+
+// CompareAndSet writes app like Set, but only if the stored ResourceVersion
+// still equals expectedVersion.
+func (s *redisApplicationStore) CompareAndSet(ctx context.Context, app *Application, expectedVersion uint64, fields ...string) error {
+	err := s.transactionalWrite(ctx, app, fields, func(current uint64) error {
+		if current != expectedVersion {
+			return ErrConflict
+		}
+		return nil
+	})
+	if err == redis.TxFailedErr {
+		return ErrConflict
+	}
+	return err
+}
+
+// transactionalWrite bumps app's resource_version and writes its fields
+// inside a WATCH/MULTI/EXEC transaction on the application's key, so the
+// read of the current version, the check (if any) and the write are atomic
+// with respect to every other Set/CompareAndSet caller. check, when given,
+// is run against the version read inside the transaction and can veto the
+// write by returning an error, e.g. ErrConflict.
+func (s *redisApplicationStore) transactionalWrite(ctx context.Context, app *Application, fields []string, check func(current uint64) error) error {
+	key := s.key(app.AppID)
+
+	txf := func(tx *redis.Tx) error {
+		current, err := tx.HGet(ctx, key, "resource_version").Uint64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if check != nil {
+			if err := check(current); err != nil {
+				return err
+			}
+		}
+
+		newVersion := current + 1
+		app.ResourceVersion = newVersion
+		raw, err := encodeApplication(app, fields...)
+		if err != nil {
+			return err
+		}
+		raw["resource_version"] = newVersion
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, raw)
+			return nil
+		})
+		return err
+	}
+
+	return s.client.Watch(ctx, txf, key)
+}
+
+func (s *redisApplicationStore) Delete(ctx context.Context, appID string) error {
+	return s.client.Del(ctx, s.key(appID)).Err()
+}
+
+// encodeApplication flattens app into a Redis hash, restricted to fields
+// when given so a Set() can patch a subset of attributes.
+func encodeApplication(app *Application, fields ...string) (map[string]interface{}, error) {
+	all := map[string]interface{}{
+		"app_id":    app.AppID,
+		"decoder":   app.Decoder,
+		"converter": app.Converter,
+		"validator": app.Validator,
+		"encoder":   app.Encoder,
+	}
+	if len(fields) == 0 {
+		return all, nil
+	}
+	raw := map[string]interface{}{"app_id": app.AppID}
+	for _, field := range fields {
+		if val, ok := all[field]; ok {
+			raw[field] = val
+		}
+	}
+	return raw, nil
+}
+
+func decodeApplication(raw map[string]string) (*Application, error) {
+	app := &Application{
+		AppID:     raw["app_id"],
+		Decoder:   raw["decoder"],
+		Converter: raw["converter"],
+		Validator: raw["validator"],
+		Encoder:   raw["encoder"],
+	}
+	if v, ok := raw["resource_version"]; ok {
+		version, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		app.ResourceVersion = version
+	}
+	return app, nil
+}
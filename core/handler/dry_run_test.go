@@ -9,6 +9,8 @@ import (
 	pb "github.com/TheThingsNetwork/ttn/api/handler"
 	"github.com/TheThingsNetwork/ttn/core/handler/application"
 	. "github.com/TheThingsNetwork/ttn/utils/testing"
+	"github.com/alicebob/miniredis/v2"
+	redis "github.com/go-redis/redis/v8"
 	. "github.com/smartystreets/assertions"
 	"golang.org/x/net/context" // See https://github.com/grpc/grpc-go/issues/711"
 )
@@ -40,30 +42,52 @@ func (s *countingStore) Count(name string) int {
 	return val
 }
 
-func (s *countingStore) List() ([]*application.Application, error) {
+func (s *countingStore) List(ctx context.Context) ([]*application.Application, error) {
 	s.inc("list")
-	return s.store.List()
+	return s.store.List(ctx)
 }
 
-func (s *countingStore) Get(appID string) (*application.Application, error) {
+func (s *countingStore) Get(ctx context.Context, appID string) (*application.Application, error) {
 	s.inc("get")
-	return s.store.Get(appID)
+	return s.store.Get(ctx, appID)
 }
 
-func (s *countingStore) Set(app *application.Application, fields ...string) error {
+func (s *countingStore) Set(ctx context.Context, app *application.Application, fields ...string) error {
 	s.inc("set")
-	return s.store.Set(app, fields...)
+	return s.store.Set(ctx, app, fields...)
 }
 
-func (s *countingStore) Delete(appID string) error {
+func (s *countingStore) CompareAndSet(ctx context.Context, app *application.Application, expectedVersion uint64, fields ...string) error {
+	s.inc("cas")
+	return s.store.CompareAndSet(ctx, app, expectedVersion, fields...)
+}
+
+func (s *countingStore) Delete(ctx context.Context, appID string) error {
 	s.inc("delete")
-	return s.store.Delete(appID)
+	return s.store.Delete(ctx, appID)
+}
+
+// newTestApplicationStore spins up an in-process miniredis instance so
+// these tests don't depend on GetRedisClient() pointing at a real Redis.
+func newTestApplicationStore(t *testing.T, prefix string) (application.Store, func()) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Unable to start miniredis: %v", err)
+	}
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	store := application.NewRedisApplicationStore(client, prefix)
+	return store, func() {
+		client.Close()
+		server.Close()
+	}
 }
 
 func TestDryUplinkFields(t *testing.T) {
 	a := New(t)
 
-	store := newCountingStore(application.NewRedisApplicationStore(GetRedisClient(), "handler-test-dry-uplink"))
+	backend, cleanup := newTestApplicationStore(t, "handler-test-dry-uplink")
+	defer cleanup()
+	store := newCountingStore(backend)
 	h := &handler{
 		applications: store,
 	}
@@ -105,13 +129,16 @@ func TestDryUplinkFields(t *testing.T) {
 	a.So(store.Count("list"), ShouldEqual, 0)
 	a.So(store.Count("get"), ShouldEqual, 0)
 	a.So(store.Count("set"), ShouldEqual, 0)
+	a.So(store.Count("cas"), ShouldEqual, 0)
 	a.So(store.Count("delete"), ShouldEqual, 0)
 }
 
 func TestDryUplinkEmptyApp(t *testing.T) {
 	a := New(t)
 
-	store := newCountingStore(application.NewRedisApplicationStore(GetRedisClient(), "handler-test-dry-uplink"))
+	backend, cleanup := newTestApplicationStore(t, "handler-test-dry-uplink")
+	defer cleanup()
+	store := newCountingStore(backend)
 	h := &handler{
 		applications: store,
 	}
@@ -132,13 +159,16 @@ func TestDryUplinkEmptyApp(t *testing.T) {
 	a.So(store.Count("list"), ShouldEqual, 0)
 	a.So(store.Count("get"), ShouldEqual, 0)
 	a.So(store.Count("set"), ShouldEqual, 0)
+	a.So(store.Count("cas"), ShouldEqual, 0)
 	a.So(store.Count("delete"), ShouldEqual, 0)
 }
 
 func TestDryDownlinkFields(t *testing.T) {
 	a := New(t)
 
-	store := newCountingStore(application.NewRedisApplicationStore(GetRedisClient(), "handler-test-dry-downlink"))
+	backend, cleanup := newTestApplicationStore(t, "handler-test-dry-downlink")
+	defer cleanup()
+	store := newCountingStore(backend)
 	h := &handler{
 		applications: store,
 	}
@@ -170,13 +200,16 @@ func TestDryDownlinkFields(t *testing.T) {
 	a.So(store.Count("list"), ShouldEqual, 0)
 	a.So(store.Count("get"), ShouldEqual, 0)
 	a.So(store.Count("set"), ShouldEqual, 0)
+	a.So(store.Count("cas"), ShouldEqual, 0)
 	a.So(store.Count("delete"), ShouldEqual, 0)
 }
 
 func TestDryDownlinkPayload(t *testing.T) {
 	a := New(t)
 
-	store := newCountingStore(application.NewRedisApplicationStore(GetRedisClient(), "handler-test-dry-downlink"))
+	backend, cleanup := newTestApplicationStore(t, "handler-test-dry-downlink")
+	defer cleanup()
+	store := newCountingStore(backend)
 	h := &handler{
 		applications: store,
 	}
@@ -199,13 +232,16 @@ func TestDryDownlinkPayload(t *testing.T) {
 	a.So(store.Count("list"), ShouldEqual, 0)
 	a.So(store.Count("get"), ShouldEqual, 0)
 	a.So(store.Count("set"), ShouldEqual, 0)
+	a.So(store.Count("cas"), ShouldEqual, 0)
 	a.So(store.Count("delete"), ShouldEqual, 0)
 }
 
 func TestDryDownlinkEmptyApp(t *testing.T) {
 	a := New(t)
 
-	store := newCountingStore(application.NewRedisApplicationStore(GetRedisClient(), "handler-test-dry-downlink"))
+	backend, cleanup := newTestApplicationStore(t, "handler-test-dry-downlink")
+	defer cleanup()
+	store := newCountingStore(backend)
 	h := &handler{
 		applications: store,
 	}
@@ -222,13 +258,16 @@ func TestDryDownlinkEmptyApp(t *testing.T) {
 	a.So(store.Count("list"), ShouldEqual, 0)
 	a.So(store.Count("get"), ShouldEqual, 0)
 	a.So(store.Count("set"), ShouldEqual, 0)
+	a.So(store.Count("cas"), ShouldEqual, 0)
 	a.So(store.Count("delete"), ShouldEqual, 0)
 }
 
 func TestLogs(t *testing.T) {
 	a := New(t)
 
-	store := newCountingStore(application.NewRedisApplicationStore(GetRedisClient(), "handler-test-dry-downlink"))
+	backend, cleanup := newTestApplicationStore(t, "handler-test-dry-downlink")
+	defer cleanup()
+	store := newCountingStore(backend)
 	h := &handler{
 		applications: store,
 	}
@@ -259,3 +298,28 @@ func TestLogs(t *testing.T) {
 		},
 	})
 }
+
+func TestApplicationStoreCompareAndSetRace(t *testing.T) {
+	a := New(t)
+	ctx := context.TODO()
+
+	backend, cleanup := newTestApplicationStore(t, "handler-test-cas")
+	defer cleanup()
+	store := newCountingStore(backend)
+
+	app := &application.Application{AppID: "racy", Decoder: "v1"}
+	a.So(store.Set(ctx, app), ShouldBeNil)
+
+	// Two dashboard saves race on the same, now-stale, expected version.
+	first := &application.Application{AppID: "racy", Decoder: "from tab 1"}
+	second := &application.Application{AppID: "racy", Decoder: "from tab 2"}
+
+	a.So(store.CompareAndSet(ctx, first, app.ResourceVersion), ShouldBeNil)
+	a.So(store.CompareAndSet(ctx, second, app.ResourceVersion), ShouldEqual, application.ErrConflict)
+
+	got, err := store.Get(ctx, "racy")
+	a.So(err, ShouldBeNil)
+	a.So(got.Decoder, ShouldEqual, "from tab 1")
+
+	a.So(store.Count("cas"), ShouldEqual, 2)
+}
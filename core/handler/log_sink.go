@@ -0,0 +1,93 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/TheThingsNetwork/ttn/api/handler"
+)
+
+// logSinkBufferSize bounds how many LogEntrys a logBroadcaster keeps around
+// per application, both as replay for newly-attached subscribers and as the
+// per-subscriber delivery buffer.
+const logSinkBufferSize = 20
+
+// LogSink receives the LogEntrys passed to Log for an application, which
+// SubscribeApplicationLogs then streams. Only entries handed to Log get
+// there: the uplink and downlink processing does not call Log, and
+// DryUplink/DryDownlink build their own one-shot []*pb.LogEntry without
+// going through a LogSink.
+type LogSink interface {
+	Log(appID string, entry *pb.LogEntry)
+}
+
+// logBroadcaster is the handler's LogSink. It keeps a bounded ring buffer of
+// recent LogEntrys per application, and fans out every new entry to the
+// gRPC subscribers currently listening for that application.
+type logBroadcaster struct {
+	mu   sync.Mutex
+	apps map[string]*appLogs
+}
+
+type appLogs struct {
+	ring        []*pb.LogEntry
+	subscribers map[chan *pb.LogEntry]struct{}
+}
+
+// newLogBroadcaster creates an empty LogSink.
+func newLogBroadcaster() *logBroadcaster {
+	return &logBroadcaster{apps: make(map[string]*appLogs)}
+}
+
+func (b *logBroadcaster) logsFor(appID string) *appLogs {
+	logs, ok := b.apps[appID]
+	if !ok {
+		logs = &appLogs{subscribers: make(map[chan *pb.LogEntry]struct{})}
+		b.apps[appID] = logs
+	}
+	return logs
+}
+
+// Log implements LogSink.
+func (b *logBroadcaster) Log(appID string, entry *pb.LogEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	logs := b.logsFor(appID)
+	logs.ring = append(logs.ring, entry)
+	if len(logs.ring) > logSinkBufferSize {
+		logs.ring = logs.ring[len(logs.ring)-logSinkBufferSize:]
+	}
+
+	for subscriber := range logs.subscribers {
+		select {
+		case subscriber <- entry:
+		default: // a slow subscriber must not block ingestion of new logs
+		}
+	}
+}
+
+// Subscribe registers a new listener for appID's logs. It returns a replay
+// of the entries still in the ring buffer, and a channel of every entry
+// logged afterwards. The subscription is torn down as soon as ctx is done,
+// so a disconnected gRPC client's goroutine doesn't leak.
+func (b *logBroadcaster) Subscribe(ctx context.Context, appID string) ([]*pb.LogEntry, <-chan *pb.LogEntry) {
+	b.mu.Lock()
+	logs := b.logsFor(appID)
+	replay := append([]*pb.LogEntry(nil), logs.ring...)
+	subscriber := make(chan *pb.LogEntry, logSinkBufferSize)
+	logs.subscribers[subscriber] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(logs.subscribers, subscriber)
+		b.mu.Unlock()
+	}()
+
+	return replay, subscriber
+}
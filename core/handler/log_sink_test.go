@@ -0,0 +1,79 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/TheThingsNetwork/ttn/api/handler"
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+	. "github.com/smartystreets/assertions"
+)
+
+func TestLogBroadcasterFanOut(t *testing.T) {
+	a := New(t)
+
+	sink := newLogBroadcaster()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	replay, live := sink.Subscribe(ctx, "app1")
+	a.So(replay, ShouldBeEmpty)
+
+	entry := &pb.LogEntry{Function: "decoder", Fields: []string{"1"}}
+	sink.Log("app1", entry)
+
+	select {
+	case got := <-live:
+		a.So(got, ShouldEqual, entry)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the subscriber to receive the new LogEntry")
+	}
+
+	// A subscriber on a different application must not see it.
+	sink.Log("app2", &pb.LogEntry{Function: "decoder", Fields: []string{"2"}})
+	select {
+	case got := <-live:
+		t.Fatalf("Unexpected entry delivered to app1 subscriber: %v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLogBroadcasterReplay(t *testing.T) {
+	a := New(t)
+
+	sink := newLogBroadcaster()
+	first := &pb.LogEntry{Function: "decoder", Fields: []string{"1"}}
+	second := &pb.LogEntry{Function: "encoder", Fields: []string{"2"}}
+	sink.Log("app1", first)
+	sink.Log("app1", second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	replay, _ := sink.Subscribe(ctx, "app1")
+	a.So(replay, ShouldResemble, []*pb.LogEntry{first, second})
+}
+
+func TestLogBroadcasterUnsubscribesOnCancel(t *testing.T) {
+	a := New(t)
+
+	sink := newLogBroadcaster()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sink.Subscribe(ctx, "app1")
+	cancel()
+
+	// Give the teardown goroutine a moment to run, then confirm the
+	// subscriber was dropped.
+	time.Sleep(50 * time.Millisecond)
+
+	sink.mu.Lock()
+	count := len(sink.apps["app1"].subscribers)
+	sink.mu.Unlock()
+
+	a.So(count, ShouldEqual, 0)
+}
@@ -0,0 +1,38 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	pb "github.com/TheThingsNetwork/ttn/api/handler"
+)
+
+// SubscribeApplicationLogs implements the handlerManager service. It streams
+// every LogEntry logged to h.handler.logs for id.AppId, replaying whatever
+// is still in the ring buffer before switching to live delivery, until the
+// client disconnects. Only entries passed to h.handler.logs.Log show up
+// here (see LogSink).
+func (h *handlerManager) SubscribeApplicationLogs(id *pb.ApplicationIdentifier, stream pb.HandlerManager_SubscribeApplicationLogsServer) error {
+	ctx := stream.Context()
+
+	replay, live := h.handler.logs.Subscribe(ctx, id.AppId)
+	for _, entry := range replay {
+		if err := stream.Send(entry); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case entry, ok := <-live:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(entry); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
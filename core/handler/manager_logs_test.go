@@ -0,0 +1,81 @@
+// Copyright © 2017 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/TheThingsNetwork/ttn/api/handler"
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+	. "github.com/smartystreets/assertions"
+	"google.golang.org/grpc"
+)
+
+// fakeSubscribeApplicationLogsStream is a minimal
+// pb.HandlerManager_SubscribeApplicationLogsServer that records every
+// LogEntry sent to it, so tests can drive SubscribeApplicationLogs without a
+// real gRPC connection.
+type fakeSubscribeApplicationLogsStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent chan *pb.LogEntry
+}
+
+func (s *fakeSubscribeApplicationLogsStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeSubscribeApplicationLogsStream) Send(entry *pb.LogEntry) error {
+	s.sent <- entry
+	return nil
+}
+
+// TestSubscribeApplicationLogs exercises the RPC end to end: it replays
+// whatever's already in the LogSink, then logs a live entry to the
+// handler's LogSink directly, and asserts the stream receives both.
+func TestSubscribeApplicationLogs(t *testing.T) {
+	a := New(t)
+
+	h := &handler{logs: newLogBroadcaster()}
+	m := &handlerManager{handler: h}
+
+	replayed := &pb.LogEntry{Function: "decoder", Fields: []string{"replayed"}}
+	h.logs.Log("app1", replayed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &fakeSubscribeApplicationLogsStream{ctx: ctx, sent: make(chan *pb.LogEntry, 2)}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.SubscribeApplicationLogs(&pb.ApplicationIdentifier{AppId: "app1"}, stream)
+	}()
+
+	select {
+	case got := <-stream.sent:
+		a.So(got, ShouldEqual, replayed)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the replayed LogEntry to be sent")
+	}
+
+	live := &pb.LogEntry{Function: "encoder", Fields: []string{"live"}}
+	h.logs.Log("app1", live)
+
+	select {
+	case got := <-stream.sent:
+		a.So(got, ShouldEqual, live)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the live LogEntry to be sent")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		a.So(err, ShouldEqual, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected SubscribeApplicationLogs to return once the context is done")
+	}
+}